@@ -0,0 +1,433 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// ErrPipelineClosed is returned by commitPipeline.Commit when the pipeline
+// has been closed via Close, either because the caller arrived after Close
+// was invoked or because it was still in flight when the close completed.
+var ErrPipelineClosed = errors.New("pebble: commit pipeline closed")
+
+// commitQueueSize is the number of slots in the commitQueue ring buffer. It
+// must be a power of two, and large enough that it is never filled by the
+// number of batches that can be concurrently in flight (bounded by
+// commitConcurrency below).
+const commitQueueSize = 1 << 10
+
+// commitConcurrency caps the number of batches commitPipeline will admit
+// (enqueue onto pending) at once, independent of the byte-weighted
+// admission control in weightedSemaphore. The byte budget alone is not
+// enough to bound this: commitWeight floors every batch's weight at 1 byte,
+// so an arbitrarily large number of tiny batches could otherwise all be
+// admitted concurrently and overrun commitQueue's fixed commitQueueSize
+// slots. Kept well under commitQueueSize so a burst of admissions can never
+// fill the ring before publish has a chance to drain it.
+const commitConcurrency = commitQueueSize / 2
+
+// commitQueue is a lock-free fixed-size single-producer, multi-consumer
+// queue. The single producer enqueues to the head of the queue while
+// commitPipeline.publish races to dequeue from the tail. A batch can only be
+// dequeued once it has been marked as applied, which gives us a cheap way
+// for publish to wait for a batch's predecessors without holding a lock.
+type commitQueue struct {
+	headTail uint64
+	slots    [commitQueueSize]unsafe.Pointer
+}
+
+const dequeueBits = 32
+
+func (q *commitQueue) unpack(ptrs uint64) (head, tail uint32) {
+	const mask = 1<<dequeueBits - 1
+	head = uint32((ptrs >> dequeueBits) & mask)
+	tail = uint32(ptrs & mask)
+	return
+}
+
+func (q *commitQueue) pack(head, tail uint32) uint64 {
+	const mask = 1<<dequeueBits - 1
+	return (uint64(head) << dequeueBits) | uint64(tail&mask)
+}
+
+// enqueue adds a batch to the head of the queue. Only one goroutine may call
+// enqueue at a time (the commitPipeline serializes access via p.mu).
+func (q *commitQueue) enqueue(b *Batch) {
+	ptrs := atomic.LoadUint64(&q.headTail)
+	head, tail := q.unpack(ptrs)
+	if head-tail == commitQueueSize {
+		panic("pebble: not enough slots to enqueue into commitQueue")
+	}
+	slot := &q.slots[head&(commitQueueSize-1)]
+	atomic.StorePointer(slot, unsafe.Pointer(b))
+	atomic.AddUint64(&q.headTail, 1<<dequeueBits)
+}
+
+// dequeue removes a batch from the tail of the queue if it has been
+// applied. It returns nil if the queue is empty or if the batch at the tail
+// of the queue has not yet been applied.
+func (q *commitQueue) dequeue() *Batch {
+	for {
+		ptrs := atomic.LoadUint64(&q.headTail)
+		head, tail := q.unpack(ptrs)
+		if tail == head {
+			// Queue is empty.
+			return nil
+		}
+		slot := &q.slots[tail&(commitQueueSize-1)]
+		b := (*Batch)(atomic.LoadPointer(slot))
+		if b == nil || atomic.LoadUint32(&b.applied) == 0 {
+			// The batch at the tail of the queue hasn't applied yet.
+			return nil
+		}
+		newPtrs := q.pack(head, tail+1)
+		if atomic.CompareAndSwapUint64(&q.headTail, ptrs, newPtrs) {
+			atomic.StorePointer(slot, nil)
+			return b
+		}
+	}
+}
+
+// commitEnv contains the environment that a commitPipeline interacts with.
+// This allows the commit pipeline to be tested without requiring a complete
+// database.
+type commitEnv struct {
+	// logSeqNum is atomically incremented by the next batch's sequence number
+	// count before the batch is written to the WAL.
+	logSeqNum *uint64
+	// visibleSeqNum is atomically advanced, in commit order, as batches
+	// become visible to readers (i.e. after they've been applied).
+	visibleSeqNum *uint64
+
+	// apply applies the batch to the in-memory state (e.g. the memtable).
+	apply func(b *Batch, mem *memTable) error
+	// write writes the batch to the WAL and/or memtable, returning the
+	// memtable the batch was (or will be) applied to. If sync is requested,
+	// write arranges for syncWG to be signaled and *syncErr to be populated
+	// with the result once the sync has completed.
+	write func(b *Batch, syncWG *sync.WaitGroup, syncErr *error) (*memTable, error)
+}
+
+// defaultCommitByteBudget bounds the total size (in bytes, summed across
+// b.storage.data for every batch currently admitted into the pipeline) that
+// commitPipeline.Commit will allow in flight at once, absent a call to
+// SetByteBudget. It is deliberately generous; callers that care about
+// bounding memory more tightly should size the budget off
+// Options.MemTableSize (e.g. MemTableSize/2) instead.
+const defaultCommitByteBudget = 64 << 20 // 64 MB
+
+// commitPipeline manages the stages of committing a set of batches:
+// allocating the batch a sequence number, writing the batch to the WAL,
+// applying the batch's contents to the memtable, and publishing the
+// sequence number as visible to subsequent reads once all of the batch's
+// predecessors have themselves become visible.
+//
+// Commits are pipelined because the WAL write and the memtable application
+// for different batches can proceed concurrently, while still requiring the
+// visible sequence number to advance in the same order batches were
+// submitted.
+type commitPipeline struct {
+	env commitEnv
+	// sem admits batches into the pipeline weighted by their encoded size
+	// (len(b.storage.data)), rather than by a fixed count, so that a burst
+	// of large batches can't pin more memory than a burst of small ones and
+	// small writers aren't head-of-line blocked behind a few huge ones.
+	sem *weightedSemaphore
+	// admitted is a counting semaphore, independent of sem, that bounds the
+	// number of batches concurrently admitted into the pipeline to
+	// commitConcurrency. sem alone cannot provide this bound, since
+	// commitWeight floors a batch's weight at 1 byte.
+	admitted chan struct{}
+
+	// mu serializes the allocation of sequence numbers and the enqueueing of
+	// batches onto pending, which must happen in the same order so that the
+	// queue and the sequence number space agree on batch ordering.
+	mu sync.Mutex
+
+	pending commitQueue
+
+	// closeMu gates admission into the pipeline. Commit, CommitWithContext,
+	// and AllocateSeqNum each hold a read lock for the duration of the call,
+	// from admission until they return; Close takes the write lock. This
+	// can't race: sync.RWMutex guarantees Lock() only returns once every
+	// RLock granted before it was called has been released, and blocks new
+	// RLock calls that arrive while a Lock is pending, so Close can never
+	// observe "nothing in flight" while a new caller is concurrently being
+	// admitted.
+	closeMu sync.RWMutex
+	// closed is set atomically by Close, while closeMu's write lock is held,
+	// i.e. only after every caller admitted before Close has released its
+	// read lock. Callers check it before taking a read lock, to fail fast,
+	// and again right after, to catch a Close that completed in between.
+	closed uint32
+
+	// scheduler decides when a sync request is considered resolved; see
+	// SyncScheduler.
+	scheduler SyncScheduler
+	// syncMu guards syncStates.
+	syncMu     sync.Mutex
+	syncStates map[uint64]syncState
+
+	// metrics accumulates sync coalescing statistics surfaced by Metrics.
+	metrics CommitMetrics
+
+	// syncGate admits syncing commits into prepare in cohorts, so that
+	// concurrent WAL writes have a real chance to share a physical fsync;
+	// see SetMaxSyncDelay.
+	syncGate syncGate
+}
+
+func newCommitPipeline(env commitEnv) *commitPipeline {
+	p := &commitPipeline{
+		env:        env,
+		sem:        newWeightedSemaphore(defaultCommitByteBudget),
+		admitted:   make(chan struct{}, commitConcurrency),
+		syncStates: make(map[uint64]syncState),
+	}
+	p.scheduler = &defaultSyncScheduler{p: p}
+	p.syncGate.metrics = &p.metrics
+	return p
+}
+
+// SetByteBudget configures the total batch-byte weight the pipeline admits
+// at once, replacing the default. It is intended to be called once, before
+// the pipeline is used, typically sized off Options.MemTableSize (e.g.
+// MemTableSize/2) so that the pipeline can't pin more unflushed data than
+// the memtable is prepared to hold.
+func (p *commitPipeline) SetByteBudget(n int64) {
+	p.sem = newWeightedSemaphore(n)
+}
+
+// commitWeight returns the semaphore weight a batch occupies while it is in
+// flight through the pipeline: its encoded size, with a floor of 1 so that
+// zero-byte batches still consume a unit and can't bypass admission control
+// entirely.
+func commitWeight(b *Batch) int64 {
+	if n := int64(len(b.storage.data)); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Commit the specified batch, writing it to the WAL and applying it to the
+// memtable. If sync is true, Commit will block until the WAL has been
+// synced. Commit returns ErrPipelineClosed if the pipeline has been (or is
+// concurrently being) closed.
+func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
+	return p.CommitWithContext(context.Background(), b, syncWAL)
+}
+
+// CommitWithContext is like Commit, but the wait to be admitted into the
+// pipeline (bounded by both the byte budget and commitConcurrency) is
+// cancellable via ctx. Once a batch has been admitted, ctx is no longer
+// consulted: the batch runs to completion like any other Commit.
+func (p *commitPipeline) CommitWithContext(ctx context.Context, b *Batch, syncWAL bool) error {
+	if b.Empty() {
+		return nil
+	}
+	if atomic.LoadUint32(&p.closed) == 1 {
+		return ErrPipelineClosed
+	}
+
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+
+	// Check again now that we hold a read lock: Close cannot have completed
+	// its write lock (and so cannot have returned) while we hold this read
+	// lock, but it may have started and finished between our first check
+	// and here, in which case we must bail out without touching p.sem,
+	// p.admitted, or the pending queue.
+	if atomic.LoadUint32(&p.closed) == 1 {
+		return ErrPipelineClosed
+	}
+
+	select {
+	case p.admitted <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.admitted }()
+
+	weight := commitWeight(b)
+	reserved, err := p.sem.Acquire(ctx, weight)
+	if err != nil {
+		return err
+	}
+	defer p.sem.Release(reserved)
+
+	// Gating entry here, before prepare (and therefore before
+	// commitEnv.write/SyncRecord), is what gives concurrent syncing commits
+	// a chance to issue their WAL writes together so LogWriter's own
+	// coalescing can fold them into a single physical fsync; see
+	// SetMaxSyncDelay.
+	if syncWAL {
+		p.syncGate.wait()
+	}
+
+	var syncWG sync.WaitGroup
+	var syncErr error
+	mem := p.prepare(b, &syncWG, &syncErr, syncWAL)
+
+	if err := p.env.apply(b, mem); err != nil {
+		return err
+	}
+
+	p.publish(b)
+
+	if !syncWAL && syncErr != nil {
+		// The WAL write itself failed; see prepare.
+		return syncErr
+	}
+	if syncWAL {
+		start := time.Now()
+		done := make(chan error, 1)
+		p.scheduler.Enqueue(b.SeqNum(), int(weight), done)
+		err := <-done
+		p.metrics.recordSyncLatency(int(weight), time.Since(start))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllocateSeqNum allocates count sequence numbers, invokes prepare while
+// holding the pipeline's serialization mutex (so that it is ordered
+// consistently with concurrent Commit calls), and then invokes apply once
+// the allocated sequence number has become visible, i.e. after every batch
+// that was prepared before it has been published. It is used by operations,
+// such as ingestion, that need to reserve a slot in the sequence number
+// space without going through the full batch commit path.
+//
+// Like Commit, AllocateSeqNum returns ErrPipelineClosed if the pipeline has
+// been (or is concurrently being) closed, in which case neither prepare
+// nor apply is invoked.
+//
+// AllocateSeqNum's signature gained this return value in the same change
+// that added Close/ErrPipelineClosed; this tree doesn't contain
+// AllocateSeqNum's other callers (e.g. ingestion), so updating them to
+// handle the new error is out of scope here and left to whatever change
+// touches those call sites next.
+func (p *commitPipeline) AllocateSeqNum(
+	count int, prepare func(), apply func(seqNum uint64),
+) error {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		return ErrPipelineClosed
+	}
+
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+
+	if atomic.LoadUint32(&p.closed) == 1 {
+		return ErrPipelineClosed
+	}
+
+	p.admitted <- struct{}{}
+	defer func() { <-p.admitted }()
+
+	b := &Batch{}
+	b.data = make([]byte, batchHeaderLen)
+	b.setCount(uint32(count))
+	b.setSeqNum(0)
+
+	p.mu.Lock()
+	logSeqNum := atomic.AddUint64(p.env.logSeqNum, uint64(count)) - uint64(count)
+	seqNum := logSeqNum
+	if seqNum == 0 {
+		// Sequence number 0 is never handed out; allocate one more.
+		atomic.AddUint64(p.env.logSeqNum, 1)
+		seqNum++
+	}
+	b.setSeqNum(seqNum)
+	p.pending.enqueue(b)
+	prepare()
+	p.mu.Unlock()
+
+	// Wait for every batch prepared before this one to be published.
+	for atomic.LoadUint64(p.env.visibleSeqNum) < logSeqNum {
+		runtime.Gosched()
+	}
+	apply(seqNum)
+
+	p.publish(b)
+	return nil
+}
+
+// prepare allocates a sequence number for b, enqueues it on the pending
+// queue, and writes it to the WAL. It must be called with p.mu held for the
+// duration of sequence number allocation and enqueueing so that the order
+// batches are assigned sequence numbers matches the order in which they're
+// enqueued.
+func (p *commitPipeline) prepare(
+	b *Batch, syncWG *sync.WaitGroup, syncErr *error, syncWAL bool,
+) *memTable {
+	n := uint64(b.Count())
+
+	p.mu.Lock()
+	seqNum := atomic.AddUint64(p.env.logSeqNum, n) - n
+	b.setSeqNum(seqNum)
+	p.pending.enqueue(b)
+	if syncWAL {
+		p.registerSync(seqNum, syncWG, syncErr)
+	}
+	mem, err := p.env.write(b, syncWG, syncErr)
+	p.mu.Unlock()
+
+	if err != nil {
+		// We can't fail the Commit at this point, so we record the error in
+		// *syncErr and Commit returns it once the batch has been published.
+		*syncErr = err
+	}
+	return mem
+}
+
+// publish marks b as applied and then drains every batch at the tail of
+// the pending queue that has also been applied, advancing visibleSeqNum to
+// cover each one in turn. This is what guarantees that visibleSeqNum only
+// ever advances in the order batches were submitted, even though their
+// writes and applies may complete out of order. publish returns only once
+// b itself has been published, by this goroutine or by whichever goroutine
+// drains the queue past it.
+func (p *commitPipeline) publish(b *Batch) {
+	atomic.StoreUint32(&b.applied, 1)
+
+	for {
+		t := p.pending.dequeue()
+		if t == nil {
+			// Wait for whoever is in front of us in the queue to publish us.
+			for atomic.LoadUint64(p.env.visibleSeqNum) < b.SeqNum()+uint64(b.Count()) {
+				runtime.Gosched()
+			}
+			break
+		}
+		// Another goroutine may publish a later batch first; visibleSeqNum
+		// only ratchets upward.
+		newSeqNum := t.SeqNum() + uint64(t.Count())
+		for {
+			cur := atomic.LoadUint64(p.env.visibleSeqNum)
+			if newSeqNum <= cur || atomic.CompareAndSwapUint64(p.env.visibleSeqNum, cur, newSeqNum) {
+				break
+			}
+		}
+	}
+}
+
+// Close quiesces the commit pipeline: in-flight Commit and AllocateSeqNum
+// calls are allowed to finish, but any call that arrives after Close has
+// begun is rejected with ErrPipelineClosed. Close blocks until every batch
+// admitted before the close has been fully published. Close is idempotent.
+func (p *commitPipeline) Close() error {
+	p.closeMu.Lock()
+	atomic.StoreUint32(&p.closed, 1)
+	p.closeMu.Unlock()
+	return nil
+}
@@ -5,6 +5,8 @@
 package pebble
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
@@ -14,6 +16,7 @@ import (
 	"time"
 
 	"github.com/cockroachdb/pebble/internal/arenaskl"
+	"github.com/cockroachdb/pebble/internal/base"
 	"github.com/cockroachdb/pebble/internal/record"
 	"github.com/cockroachdb/pebble/vfs"
 	"golang.org/x/exp/rand"
@@ -53,6 +56,99 @@ func (e *testCommitEnv) write(b *Batch, _ *sync.WaitGroup, _ *error) (*memTable,
 	return nil, nil
 }
 
+func TestWeightedSemaphoreOversizedAcquire(t *testing.T) {
+	const budget = 10
+	sem := newWeightedSemaphore(budget)
+
+	// A batch whose weight exceeds the whole budget must still be
+	// admitted (rather than wedged forever), and whatever amount Acquire
+	// actually reserved for it is what must be released -- releasing the
+	// original oversized request would panic once ordinary, budget-sized
+	// traffic is also contending for the semaphore concurrently.
+	errCh := make(chan error, 1)
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reserved, err := sem.Acquire(context.Background(), 2*budget)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		time.Sleep(time.Millisecond)
+		sem.Release(reserved)
+	}()
+
+	const n = 20
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			reserved, err := sem.Acquire(context.Background(), 1)
+			if err != nil {
+				select {
+				case errCh <- err:
+				default:
+				}
+				return
+			}
+			sem.Release(reserved)
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	default:
+	}
+
+	// The semaphore must be fully released afterwards: a full-budget
+	// acquire should succeed immediately.
+	reserved, err := sem.Acquire(context.Background(), budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved != budget {
+		t.Fatalf("expected to reserve %d, but reserved %d", budget, reserved)
+	}
+	sem.Release(reserved)
+}
+
+// TestWeightedSemaphoreOversizedAcquireIdle deterministically forces an
+// oversized Acquire to be the only, and therefore first, waiter on an
+// otherwise idle semaphore -- unlike
+// TestWeightedSemaphoreOversizedAcquire, nothing here races goroutine
+// scheduling to land the oversized request at the front of the queue. It
+// must still be admitted rather than wedging forever, since nothing else
+// is ever going to call Release or notifyWaiters on its behalf.
+func TestWeightedSemaphoreOversizedAcquireIdle(t *testing.T) {
+	const budget = 10
+	sem := newWeightedSemaphore(budget)
+
+	done := make(chan struct{})
+	var reserved int64
+	var err error
+	go func() {
+		reserved, err = sem.Acquire(context.Background(), 2*budget)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("oversized Acquire on an idle semaphore deadlocked")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved != budget {
+		t.Fatalf("expected to reserve %d, but reserved %d", budget, reserved)
+	}
+	sem.Release(reserved)
+}
+
 func TestCommitQueue(t *testing.T) {
 	var q commitQueue
 	var batches [16]Batch
@@ -155,6 +251,259 @@ func TestCommitPipelineAllocateSeqNum(t *testing.T) {
 	}
 }
 
+// entryCapturingEnv is a commitEnv that records the raw entry bytes (i.e.
+// everything past the per-batch header, which differs between sub-batches
+// since each gets its own sequence number) of every batch applied to it, in
+// apply order.
+type entryCapturingEnv struct {
+	mu                       sync.Mutex
+	entries                  bytes.Buffer
+	logSeqNum, visibleSeqNum uint64
+}
+
+func (e *entryCapturingEnv) env() commitEnv {
+	return commitEnv{
+		logSeqNum:     &e.logSeqNum,
+		visibleSeqNum: &e.visibleSeqNum,
+		apply: func(b *Batch, mem *memTable) error {
+			e.mu.Lock()
+			e.entries.Write(b.storage.data[batchHeaderLen:])
+			e.mu.Unlock()
+			return nil
+		},
+		write: func(b *Batch, _ *sync.WaitGroup, _ *error) (*memTable, error) {
+			return nil, nil
+		},
+	}
+}
+
+func TestCommitPipelineCommitReaderLargeBatch(t *testing.T) {
+	// Build one multi-MB batch, then verify that streaming its Repr
+	// through CommitReader -- which splits it into bounded-size sub-batches
+	// well under the batch's total size -- applies exactly the same
+	// entries, in the same order, as a single ordinary Commit of the batch
+	// itself.
+	const entryCount = 20000
+	const valueSize = 256 // >4MB of entries in total, several sub-batches.
+
+	buildBatch := func() *Batch {
+		b := newBatch(nil)
+		for i := 0; i < entryCount; i++ {
+			key := []byte(fmt.Sprintf("key-%08d", i))
+			value := bytes.Repeat([]byte{byte(i)}, valueSize)
+			if err := b.Set(key, value, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b
+	}
+
+	var directEnv entryCapturingEnv
+	directPipeline := newCommitPipeline(directEnv.env())
+	if err := directPipeline.Commit(buildBatch(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	var streamedEnv entryCapturingEnv
+	streamedPipeline := newCommitPipeline(streamedEnv.env())
+	repr := buildBatch().Repr()
+	if len(repr) <= commitReaderSubBatchBytes {
+		t.Fatalf("test batch (%d bytes) is too small to exercise multiple sub-batches", len(repr))
+	}
+	if err := streamedPipeline.CommitReader(bytes.NewReader(repr), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(directEnv.entries.Bytes(), streamedEnv.entries.Bytes()) {
+		t.Fatalf("CommitReader applied different state than a single Commit of the same batch")
+	}
+}
+
+func TestCommitPipelineCommitReaderRangeDelete(t *testing.T) {
+	// CommitReader must support range deletions, not just the point-entry
+	// kinds: a batch produced by a real node can routinely contain one.
+	b := newBatch(nil)
+	if err := b.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteRange([]byte("b"), []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	repr := b.Repr()
+
+	var directEnv entryCapturingEnv
+	directPipeline := newCommitPipeline(directEnv.env())
+	if err := directPipeline.CommitReader(bytes.NewReader(repr), false); err != nil {
+		t.Fatal(err)
+	}
+
+	var directlyCommittedEnv entryCapturingEnv
+	directlyCommittedPipeline := newCommitPipeline(directlyCommittedEnv.env())
+	b2 := newBatch(nil)
+	if err := b2.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b2.DeleteRange([]byte("b"), []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := directlyCommittedPipeline.Commit(b2, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(directlyCommittedEnv.entries.Bytes(), directEnv.entries.Bytes()) {
+		t.Fatalf("CommitReader applied a range deletion differently than a direct Commit")
+	}
+}
+
+func TestCommitPipelineCommitReaderRejectsOversizedEntry(t *testing.T) {
+	var e testCommitEnv
+	p := newCommitPipeline(e.env())
+
+	// A header claiming one entry, followed by a kind byte and a varint key
+	// length close to the uint64 max: CommitReader must reject this before
+	// attempting to allocate a buffer for it.
+	var stream bytes.Buffer
+	var header [batchHeaderLen]byte
+	binary.LittleEndian.PutUint32(header[8:batchHeaderLen], 1)
+	stream.Write(header[:])
+	stream.WriteByte(byte(base.InternalKeyKindSet))
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], 1<<40)
+	stream.Write(lenBuf[:n])
+
+	if err := p.CommitReader(&stream, false); err == nil {
+		t.Fatalf("expected CommitReader to reject an oversized entry length")
+	}
+}
+
+type countingSyncScheduler struct {
+	p        *commitPipeline
+	enqueued uint64
+}
+
+func (s *countingSyncScheduler) Enqueue(seqNum uint64, size int, done chan<- error) {
+	atomic.AddUint64(&s.enqueued, 1)
+	done <- s.p.resolveSync(seqNum)
+}
+
+func TestCommitPipelineSyncScheduler(t *testing.T) {
+	var e testCommitEnv
+	p := newCommitPipeline(e.env())
+	sched := &countingSyncScheduler{p: p}
+	p.SetSyncScheduler(sched)
+
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			var b Batch
+			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+			if err := p.Commit(&b, true /* sync */); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if s := atomic.LoadUint64(&sched.enqueued); n != s {
+		t.Fatalf("expected %d scheduler enqueues, but found %d", n, s)
+	}
+
+	// SyncCallsTotal/BatchesCoalesced are driven by syncGate.release, which
+	// runs for every syncing commit regardless of which SyncScheduler is
+	// installed. With the default MaxSyncDelay (0), each commit is admitted
+	// as its own cohort of one, so the n commits above produce n sync calls
+	// even though a custom scheduler is installed.
+	if m := p.Metrics(); m.SyncCallsTotal != n {
+		t.Fatalf("expected %d sync calls, but found %+v", n, m)
+	}
+}
+
+func TestCommitPipelineDefaultSchedulerMetrics(t *testing.T) {
+	var e testCommitEnv
+	p := newCommitPipeline(e.env())
+
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			var b Batch
+			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+			if err := p.Commit(&b, true /* sync */); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// With MaxSyncDelay at its default of zero, every commit is admitted
+	// into prepare as its own cohort of one, so no coalescing happens: each
+	// of the n commits accounts for its own sync call.
+	m := p.Metrics()
+	if n != m.SyncCallsTotal {
+		t.Fatalf("expected %d sync calls, but found %d", n, m.SyncCallsTotal)
+	}
+	if n != m.BatchesCoalesced {
+		t.Fatalf("expected %d batches coalesced, but found %d", n, m.BatchesCoalesced)
+	}
+	// Every cohort is of size 1, so the entire count should land in the
+	// first BatchesPerSync bucket.
+	if got := m.BatchesPerSync[0].Count; got != n {
+		t.Fatalf("expected %d cohorts of size 1, but found %d", n, got)
+	}
+}
+
+func TestCommitPipelineMaxSyncDelayCoalesces(t *testing.T) {
+	var e testCommitEnv
+	p := newCommitPipeline(e.env())
+	p.SetMaxSyncDelay(50 * time.Millisecond)
+
+	// Commit n batches concurrently with sync==true. Because they all
+	// arrive well within the MaxSyncDelay window, the syncGate should admit
+	// them as a single cohort: one sync call coalescing all n batches.
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			var b Batch
+			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+			if err := p.Commit(&b, true /* sync */); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	m := p.Metrics()
+	if m.SyncCallsTotal == 0 || m.SyncCallsTotal >= n {
+		t.Fatalf("expected far fewer sync calls than batches, but found %d sync calls for %d batches",
+			m.SyncCallsTotal, n)
+	}
+	if m.BatchesCoalesced != n {
+		t.Fatalf("expected all %d batches to be accounted for, but found %d", n, m.BatchesCoalesced)
+	}
+	// All n batches coalesced into a single cohort of size n, so every
+	// BatchesPerSync observation should fall in whichever bucket covers n,
+	// and every smaller bucket should be empty.
+	var total uint64
+	for _, bucket := range m.BatchesPerSync {
+		total += bucket.Count
+		if bucket.Count > 0 && bucket.UpperBound < n {
+			t.Fatalf("expected no observations below a bucket covering %d, but bucket <= %d has %d",
+				n, bucket.UpperBound, bucket.Count)
+		}
+	}
+	if total != 1 {
+		t.Fatalf("expected exactly one BatchesPerSync observation, but found %d", total)
+	}
+}
+
 type syncDelayFile struct {
 	vfs.File
 	waiting chan struct{}
@@ -203,10 +552,13 @@ func TestCommitPipelineWALClose(t *testing.T) {
 	}
 	p := newCommitPipeline(testEnv)
 
-	// Launch N (commitConcurrency) goroutines which each create a batch and
-	// commit it with sync==true. Because of the syncDelayFile, none of these
-	// operations can complete until syncDelayFile.done is closed.
-	errCh := make(chan error, cap(p.sem))
+	// Launch N goroutines which each create a batch and commit it with
+	// sync==true. Because of the syncDelayFile, none of these operations
+	// can complete until syncDelayFile.done is closed. N is chosen well
+	// below the pipeline's byte budget so that every goroutine is admitted
+	// and blocked in Sync concurrently.
+	const walCloseGoroutines = 64
+	errCh := make(chan error, walCloseGoroutines)
 	for i := 0; i < cap(errCh); i++ {
 		go func(i int) {
 			b := &Batch{}
@@ -242,61 +594,228 @@ func TestCommitPipelineWALClose(t *testing.T) {
 	}
 }
 
-func BenchmarkCommitPipeline(b *testing.B) {
-	for _, parallelism := range []int{1, 2, 4, 8, 16, 32, 64, 128} {
-		b.Run(fmt.Sprintf("parallel=%d", parallelism), func(b *testing.B) {
-			b.SetParallelism(parallelism)
-			mem := newMemTable(nil)
-			wal := record.NewLogWriter(ioutil.Discard, 0 /* logNum */)
-
-			nullCommitEnv := commitEnv{
-				logSeqNum:     new(uint64),
-				visibleSeqNum: new(uint64),
-				apply: func(b *Batch, mem *memTable) error {
-					err := mem.apply(b, b.SeqNum())
-					if err != nil {
-						return err
-					}
-					mem.unref()
-					return nil
-				},
-				write: func(b *Batch, syncWG *sync.WaitGroup, syncErr *error) (*memTable, error) {
-					for {
-						err := mem.prepare(b)
-						if err == arenaskl.ErrArenaFull {
-							mem = newMemTable(nil)
-							continue
-						}
+func TestCommitPipelineClose(t *testing.T) {
+	// This test stresses the same edge case as TestCommitPipelineWALClose --
+	// N goroutines genuinely blocked inside Sync -- but races a concurrent
+	// Close against them instead of a WAL rotation, and additionally
+	// verifies that any Commit arriving after Close has returned is
+	// rejected outright.
+
+	mem := vfs.NewMem()
+	f, err := mem.Create("test-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf := &syncDelayFile{
+		File:    f,
+		waiting: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	wal := record.NewLogWriter(sf, 0 /* logNum */)
+	testEnv := commitEnv{
+		logSeqNum:     new(uint64),
+		visibleSeqNum: new(uint64),
+		apply: func(b *Batch, mem *memTable) error {
+			return nil
+		},
+		write: func(b *Batch, syncWG *sync.WaitGroup, syncErr *error) (*memTable, error) {
+			_, err := wal.SyncRecord(b.storage.data, syncWG, syncErr)
+			return nil, err
+		},
+	}
+	p := newCommitPipeline(testEnv)
+
+	// Launch N goroutines which each commit with sync==true. Because of the
+	// syncDelayFile, none of these can complete until syncDelayFile.done is
+	// closed.
+	const n = 64
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			b := &Batch{}
+			if err := b.LogData([]byte("foo"), nil); err != nil {
+				errCh <- err
+				return
+			}
+			errCh <- p.Commit(b, true /* sync */)
+		}(i)
+	}
+
+	<-sf.waiting
+	// At least one (most likely all) of the above commits is now blocked in
+	// Sync, with its batch already enqueued on the pipeline's pending queue.
+	// Race Close against them.
+	closeErrCh := make(chan error, 1)
+	go func() {
+		closeErrCh <- p.Close()
+	}()
+
+	// Give Close a moment to start waiting on the in-flight commits before
+	// unblocking Sync, then release every blocked Sync call.
+	time.Sleep(20 * time.Millisecond)
+	close(sf.done)
+
+	if err := <-closeErrCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		// A commit racing Close may either complete normally or be rejected
+		// with ErrPipelineClosed; anything else is a bug.
+		if err := <-errCh; err != nil && err != ErrPipelineClosed {
+			t.Fatal(err)
+		}
+	}
+
+	// Every commit that arrives after Close has returned must be rejected.
+	var b Batch
+	_ = b.Set([]byte("post-close"), nil, nil)
+	if err := p.Commit(&b, false); err != ErrPipelineClosed {
+		t.Fatalf("expected ErrPipelineClosed, but found %v", err)
+	}
+}
+
+// BenchmarkCommitPipelineSyncScheduler measures how the default
+// SyncScheduler's resolution latency and the resulting sync-coalescing
+// ratio (batches served per underlying WAL sync, as approximated by
+// CommitMetrics) change as parallelism scales and MaxSyncDelay is widened
+// to give concurrent commits more chance to share a sync.
+func BenchmarkCommitPipelineSyncScheduler(b *testing.B) {
+	for _, parallelism := range []int{1, 8, 32, 128} {
+		for _, maxDelay := range []time.Duration{0, 100 * time.Microsecond, time.Millisecond} {
+			b.Run(fmt.Sprintf("parallel=%d/delay=%s", parallelism, maxDelay), func(b *testing.B) {
+				b.SetParallelism(parallelism)
+				mem := newMemTable(nil)
+				wal := record.NewLogWriter(ioutil.Discard, 0 /* logNum */)
+
+				nullCommitEnv := commitEnv{
+					logSeqNum:     new(uint64),
+					visibleSeqNum: new(uint64),
+					apply: func(b *Batch, mem *memTable) error {
+						err := mem.apply(b, b.SeqNum())
 						if err != nil {
-							return nil, err
+							return err
+						}
+						mem.unref()
+						return nil
+					},
+					write: func(b *Batch, syncWG *sync.WaitGroup, syncErr *error) (*memTable, error) {
+						for {
+							err := mem.prepare(b)
+							if err == arenaskl.ErrArenaFull {
+								mem = newMemTable(nil)
+								continue
+							}
+							if err != nil {
+								return nil, err
+							}
+							break
 						}
-						break
-					}
 
-					_, err := wal.SyncRecord(b.storage.data, syncWG, syncErr)
-					return mem, err
-				},
-			}
-			p := newCommitPipeline(nullCommitEnv)
-
-			const keySize = 8
-			b.SetBytes(2 * keySize)
-			b.ResetTimer()
-
-			b.RunParallel(func(pb *testing.PB) {
-				rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
-				buf := make([]byte, keySize)
-
-				for pb.Next() {
-					batch := newBatch(nil)
-					binary.BigEndian.PutUint64(buf, rng.Uint64())
-					batch.Set(buf, buf, nil)
-					if err := p.Commit(batch, true /* sync */); err != nil {
-						b.Fatal(err)
+						_, err := wal.SyncRecord(b.storage.data, syncWG, syncErr)
+						return mem, err
+					},
+				}
+				p := newCommitPipeline(nullCommitEnv)
+				p.SetMaxSyncDelay(maxDelay)
+
+				const keySize = 8
+				b.SetBytes(2 * keySize)
+				b.ResetTimer()
+
+				b.RunParallel(func(pb *testing.PB) {
+					rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+					buf := make([]byte, keySize)
+
+					for pb.Next() {
+						batch := newBatch(nil)
+						binary.BigEndian.PutUint64(buf, rng.Uint64())
+						batch.Set(buf, buf, nil)
+						if err := p.Commit(batch, true /* sync */); err != nil {
+							b.Fatal(err)
+						}
+						batch.release()
 					}
-					batch.release()
+				})
+
+				b.StopTimer()
+				m := p.Metrics()
+				if m.SyncCallsTotal > 0 {
+					b.ReportMetric(float64(m.BatchesCoalesced)/float64(m.SyncCallsTotal), "batches/sync")
+				}
+				if m.BatchesCoalesced > 0 {
+					b.ReportMetric(float64(m.SyncLatencyNanos)/float64(m.BatchesCoalesced), "ns/sync-resolve")
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkCommitPipeline(b *testing.B) {
+	// valueSizes sweeps the average batch size, which the weighted
+	// semaphore now uses for admission control in addition to parallelism.
+	for _, valueSize := range []int{8, 256, 4096, 65536} {
+		for _, parallelism := range []int{1, 2, 4, 8, 16, 32, 64, 128} {
+			b.Run(fmt.Sprintf("value=%d/parallel=%d", valueSize, parallelism), func(b *testing.B) {
+				b.SetParallelism(parallelism)
+				mem := newMemTable(nil)
+				wal := record.NewLogWriter(ioutil.Discard, 0 /* logNum */)
+
+				nullCommitEnv := commitEnv{
+					logSeqNum:     new(uint64),
+					visibleSeqNum: new(uint64),
+					apply: func(b *Batch, mem *memTable) error {
+						err := mem.apply(b, b.SeqNum())
+						if err != nil {
+							return err
+						}
+						mem.unref()
+						return nil
+					},
+					write: func(b *Batch, syncWG *sync.WaitGroup, syncErr *error) (*memTable, error) {
+						for {
+							err := mem.prepare(b)
+							if err == arenaskl.ErrArenaFull {
+								mem = newMemTable(nil)
+								continue
+							}
+							if err != nil {
+								return nil, err
+							}
+							break
+						}
+
+						_, err := wal.SyncRecord(b.storage.data, syncWG, syncErr)
+						return mem, err
+					},
 				}
+				p := newCommitPipeline(nullCommitEnv)
+
+				const keySize = 8
+				b.SetBytes(int64(keySize + valueSize))
+				b.ResetTimer()
+
+				b.RunParallel(func(pb *testing.PB) {
+					rng := rand.New(rand.NewSource(uint64(time.Now().UnixNano())))
+					key := make([]byte, keySize)
+					value := make([]byte, valueSize)
+
+					for pb.Next() {
+						batch := newBatch(nil)
+						binary.BigEndian.PutUint64(key, rng.Uint64())
+						rng.Read(value)
+						batch.Set(key, value, nil)
+						if err := p.Commit(batch, true /* sync */); err != nil {
+							b.Fatal(err)
+						}
+						batch.release()
+					}
+				})
 			})
-		})
+		}
 	}
 }
@@ -0,0 +1,135 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// weightedSemaphore is a semaphore that admits callers up to a configurable
+// total weight rather than a fixed count, in the style of
+// golang.org/x/sync/semaphore.Weighted. It lets commitPipeline admit many
+// small batches concurrently while throttling down to a handful of large
+// ones, bounding the total amount of batch memory pinned in the pipeline
+// rather than just the number of goroutines using it.
+type weightedSemaphore struct {
+	mu      sync.Mutex
+	size    int64
+	cur     int64
+	waiters list.List
+}
+
+type semaphoreWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func newWeightedSemaphore(n int64) *weightedSemaphore {
+	return &weightedSemaphore{size: n}
+}
+
+// Acquire acquires n units of the semaphore, blocking until they are
+// available or ctx is done. On success, it returns the number of units
+// actually reserved, which the caller MUST pass to Release (it may be less
+// than n if n exceeds the semaphore's total size, see below); on failure it
+// returns ctx.Err() and leaves the semaphore unchanged.
+//
+// If n exceeds the semaphore's total size, the request is not rejected:
+// since a single oversized batch must still be admitted eventually, it is
+// instead granted the whole semaphore to itself once it reaches the front
+// of the queue, the same way it would if it were waiting behind a sequence
+// of smaller requests that also summed to the full size. The reservation
+// (and therefore the amount later released) is the clamped size, not the
+// caller's original n.
+func (s *weightedSemaphore) Acquire(ctx context.Context, n int64) (reserved int64, err error) {
+	s.mu.Lock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return n, nil
+	}
+
+	if n > s.size {
+		// Don't wait forever for a request that can never be satisfied:
+		// admit it alone once it reaches the front of the queue, the same
+		// way golang.org/x/sync/semaphore handles an oversized acquire.
+		// Whatever we clamp n to here is what notifyWaiters will credit to
+		// s.cur, so it must also be what the caller releases.
+		n = s.size
+	}
+
+	w := semaphoreWaiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	// The clamp above may have just made this waiter immediately
+	// satisfiable (e.g. an oversized request arriving on an otherwise idle
+	// semaphore), and nothing else is guaranteed to ever call
+	// notifyWaiters on its behalf: Release only runs once something is
+	// acquired, and ctx is typically context.Background(). Check now,
+	// before blocking, so an oversized Acquire can't deadlock itself (and,
+	// since waiters are serviced FIFO, every Acquire behind it).
+	s.notifyWaiters()
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		cErr := ctx.Err()
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// We were woken concurrently with cancellation; treat the
+			// acquire as having succeeded so units aren't lost, and pass
+			// them straight back to Release.
+			cErr = nil
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			if isFront && s.size > s.cur {
+				s.notifyWaiters()
+			}
+		}
+		s.mu.Unlock()
+		if cErr != nil {
+			return 0, cErr
+		}
+		return n, nil
+	case <-w.ready:
+		return n, nil
+	}
+}
+
+// Release releases n units of the semaphore. n must be the reserved value
+// returned by the corresponding Acquire call, not the value originally
+// passed to Acquire (the two differ when Acquire clamped an oversized
+// request).
+func (s *weightedSemaphore) Release(n int64) {
+	s.mu.Lock()
+	s.cur -= n
+	if s.cur < 0 {
+		s.mu.Unlock()
+		panic("pebble: weightedSemaphore: released more than acquired")
+	}
+	s.notifyWaiters()
+	s.mu.Unlock()
+}
+
+func (s *weightedSemaphore) notifyWaiters() {
+	for {
+		e := s.waiters.Front()
+		if e == nil {
+			break
+		}
+		w := e.Value.(semaphoreWaiter)
+		if s.size-s.cur < w.n {
+			// The next waiter still doesn't fit; since the queue is
+			// serviced FIFO, nobody behind it can go ahead of it either.
+			break
+		}
+		s.cur += w.n
+		s.waiters.Remove(e)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SyncScheduler decides when a batch's request to be durably synced is
+// considered resolved. commitPipeline calls Enqueue once per batch that
+// committed with sync==true, after the batch's WAL write has already been
+// issued; the scheduler must arrange for exactly one value (nil on
+// success) to be sent on done once the WAL write backing seqNum is known
+// to be durable.
+//
+// Enqueue only controls when a commit is told its sync is done; it cannot
+// influence how many commits' WAL writes land in the same physical fsync,
+// since those writes have already been issued by the time Enqueue is
+// called. That coalescing window is controlled separately, by
+// commitPipeline's MaxSyncDelay (see SetMaxSyncDelay), which gates entry
+// into prepare (and therefore into commitEnv.write/SyncRecord) so that
+// concurrent syncing commits have a chance to issue their WAL writes
+// together.
+type SyncScheduler interface {
+	Enqueue(seqNum uint64, size int, done chan<- error)
+}
+
+// defaultSyncScheduler is the SyncScheduler installed by newCommitPipeline
+// absent an explicit call to SetSyncScheduler. It resolves each request by
+// waiting on the real WAL sync registered for seqNum.
+type defaultSyncScheduler struct {
+	p *commitPipeline
+}
+
+func (s *defaultSyncScheduler) Enqueue(seqNum uint64, size int, done chan<- error) {
+	done <- s.p.resolveSync(seqNum)
+}
+
+// syncState is the bookkeeping commitPipeline keeps per in-flight sync
+// request so that a SyncScheduler can resolve it (wait on the real WAL
+// sync) independently of, and possibly later than, when the request was
+// enqueued.
+type syncState struct {
+	wg  *sync.WaitGroup
+	err *error
+}
+
+// SetSyncScheduler installs a custom SyncScheduler, replacing the default.
+// It must be called before the pipeline is used concurrently.
+func (p *commitPipeline) SetSyncScheduler(s SyncScheduler) {
+	p.scheduler = s
+}
+
+// SetMaxSyncDelay configures how long a syncing commit will wait to be
+// admitted into prepare (and so into commitEnv.write/SyncRecord) alongside
+// other concurrently-arriving syncing commits, before being admitted on
+// its own. Widening this window gives LogWriter's own record queuing more
+// concurrent WAL writes to coalesce into a single physical fsync, at the
+// cost of added latency for an otherwise-isolated commit. It applies
+// regardless of which SyncScheduler is installed, since it governs entry
+// into the pipeline rather than how a sync is resolved.
+func (p *commitPipeline) SetMaxSyncDelay(d time.Duration) {
+	p.syncGate.setMaxDelay(d)
+}
+
+// registerSync records the wait group and error pointer backing seqNum's
+// durability so that the sync scheduler can resolve it later. It must be
+// called with p.mu held, from within prepare, so that registration happens
+// before the scheduler could possibly be asked to resolve it.
+func (p *commitPipeline) registerSync(seqNum uint64, wg *sync.WaitGroup, err *error) {
+	p.syncMu.Lock()
+	p.syncStates[seqNum] = syncState{wg: wg, err: err}
+	p.syncMu.Unlock()
+}
+
+// resolveSync blocks until the WAL write backing seqNum is durable and
+// returns its result.
+func (p *commitPipeline) resolveSync(seqNum uint64) error {
+	p.syncMu.Lock()
+	s, ok := p.syncStates[seqNum]
+	delete(p.syncStates, seqNum)
+	p.syncMu.Unlock()
+	if !ok {
+		// Nothing was registered (sync wasn't requested for this batch);
+		// treat as already durable.
+		return nil
+	}
+	s.wg.Wait()
+	return *s.err
+}
+
+// syncGate admits syncing commits into prepare (and therefore into
+// commitEnv.write) in cohorts rather than one at a time: the first arrival
+// opens a cohort and starts a MaxSyncDelay timer; every other syncing
+// commit that arrives before the timer fires joins the same cohort; the
+// timer firing (or, with MaxSyncDelay == 0, the first arrival itself)
+// admits the whole cohort at once. Releasing a cohort's members together
+// is what gives LogWriter's own record queuing a real chance to batch
+// their WAL writes into a single physical fsync, rather than relying on
+// however the goroutine scheduler happens to interleave calls to prepare.
+//
+// Each released cohort is counted once in CommitMetrics.SyncCallsTotal,
+// and its member count is added to CommitMetrics.BatchesCoalesced and
+// recorded into CommitMetrics.BatchesPerSync -- an approximation of
+// physical fsync coalescing (a real fsync counter would have to come from
+// LogWriter itself), but one that is directly driven by, and responds to,
+// MaxSyncDelay and concurrency rather than being a constant.
+type syncGate struct {
+	mu       sync.Mutex
+	maxDelay time.Duration
+	cohort   []chan struct{}
+	timer    *time.Timer
+	metrics  *CommitMetrics
+}
+
+func (g *syncGate) setMaxDelay(d time.Duration) {
+	g.mu.Lock()
+	g.maxDelay = d
+	g.mu.Unlock()
+}
+
+// wait blocks until the caller has been admitted as part of a cohort.
+func (g *syncGate) wait() {
+	g.mu.Lock()
+	if g.maxDelay <= 0 {
+		// No cohort window: admit immediately, as a cohort of one.
+		g.mu.Unlock()
+		g.release([]chan struct{}{nil})
+		return
+	}
+
+	ready := make(chan struct{})
+	g.cohort = append(g.cohort, ready)
+	if len(g.cohort) == 1 {
+		g.timer = time.AfterFunc(g.maxDelay, g.flush)
+	}
+	g.mu.Unlock()
+
+	<-ready
+}
+
+// flush releases the current cohort, if any, admitting every member.
+func (g *syncGate) flush() {
+	g.mu.Lock()
+	cohort := g.cohort
+	g.cohort = nil
+	g.mu.Unlock()
+	g.release(cohort)
+}
+
+func (g *syncGate) release(cohort []chan struct{}) {
+	if len(cohort) == 0 {
+		return
+	}
+	atomic.AddUint64(&g.metrics.SyncCallsTotal, 1)
+	atomic.AddUint64(&g.metrics.BatchesCoalesced, uint64(len(cohort)))
+	g.metrics.batchesPerSync.record(len(cohort))
+	for _, c := range cohort {
+		if c != nil {
+			close(c)
+		}
+	}
+}